@@ -2,41 +2,57 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
-	"crypto/tls"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	_ "embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli"
 	"io"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/client-go/util/homedir"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	capiv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	bootstrapv1 "sigs.k8s.io/cluster-api/bootstrap/kubeadm/api/v1beta1"
+	kcpv1 "sigs.k8s.io/cluster-api/controlplane/kubeadm/api/v1beta1"
+	crclient "sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
 	"time"
 )
 
-const (
-	KUBEADMCONTROLPLANE   = "/apis/controlplane.cluster.x-k8s.io/v1beta1/namespaces/default/kubeadmcontrolplanes/"
-	KUBEADMCONFIGTEMPLATE = "/apis/bootstrap.cluster.x-k8s.io/v1beta1/namespaces/default/kubeadmconfigtemplates/"
-	MACHINEDEPLOYMENT     = "/apis/cluster.x-k8s.io/v1beta1/namespaces/default/machinedeployments/"
-)
-
 //go:embed overlay.yaml
 var ob []byte
 
 var kubeapiserver string
-var kubeclient *http.Client
+var k8sClient crclient.Client
 var kclient *rest.Config
 var certcontent string
+var skipControlPlane bool
+var namespace = "default"
+var targetCluster string
+var dryRun bool
 
 func init() {
 	fmt.Println("Checking for KubeConfig File, and Api Server Details...")
@@ -51,22 +67,78 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:     "action, a",
-			Usage:    "Select an action [append or delete] to execute, Either to Append Certs or Delete them",
+			Usage:    "Select an action [append, delete, altnames, status, rotate, watch or rollback] to execute",
 			Required: true,
 		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "preview mutations as diffs instead of applying them, and skip real backup/rollback writes",
+		},
 		cli.StringFlag{
-			Name:     "cert, c",
-			Usage:    "provide a certificate, cert path. eg. ./tkg-custom-ca.crt",
-			Required: true,
+			Name:  "id",
+			Usage: "unix timestamp id of the cclcmgr-backup secret to restore. Used by the rollback action",
+		},
+		cli.StringFlag{
+			Name:  "cert, c",
+			Usage: "provide a certificate, cert path. eg. ./tkg-custom-ca.crt. Required for append/delete",
+		},
+		cli.BoolFlag{
+			Name:  "skip-control-plane",
+			Usage: "preserve current behavior and skip rolling the cert onto control-plane nodes",
+		},
+		cli.StringSliceFlag{
+			Name:  "san",
+			Usage: "repeatable SAN to add to the kube-apiserver serving cert, eg. --san host=foo.example.com --san ip=10.0.0.5. Used by the altnames action",
+		},
+		cli.StringSliceFlag{
+			Name:  "remove-san",
+			Usage: "repeatable SAN to drop from the persisted set, same format as --san. Used by the altnames action",
+		},
+		cli.StringFlag{
+			Name:  "namespace, n",
+			Usage: "namespace the target CAPI resources live in",
+			Value: "default",
+		},
+		cli.StringFlag{
+			Name:  "cluster-name",
+			Usage: "name of the workload Cluster to target, required when a namespace has more than one",
+		},
+		cli.StringFlag{
+			Name:  "new-cert",
+			Usage: "cert path to append during a rotate, eg. ./tkg-custom-ca-2.crt",
+		},
+		cli.IntFlag{
+			Name:  "threshold-days",
+			Usage: "rotate away any managed cert expiring within this many days",
+			Value: 30,
+		},
+		cli.DurationFlag{
+			Name:  "interval",
+			Usage: "how often the watch action re-checks expiry",
+			Value: time.Hour,
 		},
 	}
 
 	app.Action = func(c *cli.Context) error {
+		skipControlPlane = c.Bool("skip-control-plane")
+		namespace = c.String("namespace")
+		targetCluster = c.String("cluster-name")
+		dryRun = c.Bool("dry-run")
 		switch c.String("action") {
 		case "append":
 			appendCerts(c.String("cert"))
 		case "delete":
 			deleteCerts(c.String("cert"))
+		case "altnames":
+			rotateAPIServerCert(c.StringSlice("san"), c.StringSlice("remove-san"))
+		case "status":
+			certStatus()
+		case "rotate":
+			rotateCerts(c.String("new-cert"), c.Int("threshold-days"))
+		case "watch":
+			watchCertExpiry(c.Duration("interval"))
+		case "rollback":
+			rollbackToBackup(c.String("id"))
 		default:
 			fmt.Println("Invalid option")
 			err := cli.ShowAppHelp(c)
@@ -140,41 +212,58 @@ func loadconfig() *rest.Config {
 	return config
 }
 
-// getkubeclient creates a http client for kubernetes cluster in the current context
+// getkubeclient builds a typed controller-runtime client for the cluster in the current
+// context, with the CAPI and KCP schemes registered alongside the core/client-go ones
 func getkubeclient(config *rest.Config) {
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(config.CAData)
-	clientCert, err := tls.X509KeyPair(config.CertData, config.KeyData)
-	if err != nil {
+	if err := capiv1.AddToScheme(scheme.Scheme); err != nil {
 		log.Fatal(err)
 	}
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs:      caCertPool,
-			Certificates: []tls.Certificate{clientCert},
-		},
+	if err := bootstrapv1.AddToScheme(scheme.Scheme); err != nil {
+		log.Fatal(err)
 	}
-	kubeclient = &http.Client{Transport: transport}
+	if err := kcpv1.AddToScheme(scheme.Scheme); err != nil {
+		log.Fatal(err)
+	}
+	c, err := crclient.New(config, crclient.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		log.Fatal(err)
+	}
+	k8sClient = c
 }
 
-// appendCerts Appends the cert to
-func appendCerts(cert string) {
-	writeFilesForFutureProvisioning()
-	createKappSecret()
+// appendCerts Appends the cert to namespace's kubeadmconfigtemplates/kubeadmcontrolplanes
+// and rolls the owning machinedeployments. It returns false when the cert file cannot be read
+// and true otherwise; a failed patch or control-plane roll of an individual object does not
+// change the result
+func appendCerts(cert string) bool {
+	if dryRun {
+		fmt.Println("[dry-run] would write provisioning overlay files and create the kapp-controller-config Secret")
+	} else {
+		writeFilesForFutureProvisioning()
+		createKappSecret()
+	}
 	fileContents, err := os.ReadFile(cert)
 	if err != nil {
 		fmt.Println("Error reading file:", err)
-		return
+		return false
 	}
 	certcontent = string(fileContents)
 	fmt.Println(certcontent)
-	for _, kadm := range getkubeadmconfigTemplatesList(kubeclient) {
-		appendKubeAdmCert(kubeclient, kadm)
+	createBackup(k8sClient)
+	for _, kadm := range getkubeadmconfigTemplatesList(k8sClient) {
+		appendKubeAdmCert(k8sClient, kadm)
+	}
+	if !skipControlPlane {
+		for _, kadmcp := range getkubeadmControlPlaneList(k8sClient) {
+			appendKubeAdmCPCert(k8sClient, kadmcp)
+		}
 	}
-	for _, md := range getMachineDeployments(kubeclient) {
+	for _, md := range getMachineDeployments(k8sClient) {
 		fmt.Println("Applying MD", md)
-		mergeMachineDeployments(kubeclient, md)
+		mergeMachineDeployments(k8sClient, md)
 	}
+	recordInventoryAppend(fileContents)
+	return true
 }
 
 func deleteCerts(cert string) {
@@ -184,432 +273,1319 @@ func deleteCerts(cert string) {
 		return
 	}
 	certcontent = string(fileContents)
-	for _, kadm := range getkubeadmconfigTemplatesList(kubeclient) {
-		deleteKubeAdmConfigCerts(kubeclient, kadm)
+	createBackup(k8sClient)
+	for _, kadm := range getkubeadmconfigTemplatesList(k8sClient) {
+		deleteKubeAdmConfigCerts(k8sClient, kadm)
 	}
-	for _, md := range getMachineDeployments(kubeclient) {
+	if !skipControlPlane {
+		for _, kadmcp := range getkubeadmControlPlaneList(k8sClient) {
+			deleteKubeAdmCPCerts(k8sClient, kadmcp)
+		}
+	}
+	for _, md := range getMachineDeployments(k8sClient) {
 		fmt.Println("Applying MD", md)
-		mergeMachineDeployments(kubeclient, md)
+		mergeMachineDeployments(k8sClient, md)
 	}
+	recordInventoryDelete(fileContents)
 }
 
-// getkubeadmControlPlaneList returns all kubeadmcontrolplane object names
-// future-implementation if MUTABLE
-func getkubeadmControlPlaneList(client *http.Client) []string {
-	resp, err := client.Get(kubeapiserver + KUBEADMCONTROLPLANE)
-	if err != nil {
-		log.Fatal("unable to retrieve with the given object", err)
+// resolveClusterName returns targetCluster if the operator pinned one with
+// --cluster-name, otherwise falls back to owner the caller already knows about
+func resolveClusterName(fallback string) string {
+	if targetCluster != "" {
+		return targetCluster
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			panic(err)
+	return fallback
+}
+
+// belongsToTargetCluster reports whether an object's cluster.x-k8s.io/cluster-name label
+// matches --cluster-name, or is always true when --cluster-name was not given
+func belongsToTargetCluster(labels map[string]string) bool {
+	if targetCluster == "" {
+		return true
+	}
+	return labels[capiv1.ClusterNameLabel] == targetCluster
+}
+
+// getkubeadmControlPlaneList returns the names of every kubeadmcontrolplane in namespace,
+// scoped to --cluster-name when set
+func getkubeadmControlPlaneList(c crclient.Client) []string {
+	var kcpList kcpv1.KubeadmControlPlaneList
+	if err := c.List(context.TODO(), &kcpList, crclient.InNamespace(namespace)); err != nil {
+		log.Fatal("unable to list kubeadmcontrolplanes: ", err)
+	}
+	var names []string
+	for _, kcp := range kcpList.Items {
+		if !belongsToTargetCluster(kcp.Labels) {
+			continue
 		}
-	}(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Unexpected status code:", resp.StatusCode)
-		os.Exit(1)
+		fmt.Println(kcp.Name)
+		names = append(names, kcp.Name)
 	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response body:", err)
-		os.Exit(1)
+	return names
+}
+
+// shortRevision derives a short, stable revision suffix from the certificate content,
+// mirroring the <name>-ca-<shortsha> naming Constellation uses for rolled control-plane CA bundles
+func shortRevision(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:7]
+}
+
+// getOwningClusterName resolves the Cluster that owns a kubeadmcontrolplane via its
+// cluster.x-k8s.io/cluster-name label, which CAPI stamps onto every object in a cluster
+func getOwningClusterName(kcp *kcpv1.KubeadmControlPlane) string {
+	if name, ok := kcp.Labels[capiv1.ClusterNameLabel]; ok {
+		return resolveClusterName(name)
 	}
-	var kadmList struct {
-		Items []struct {
-			Metadata struct {
-				Name string `json:"name"`
-			} `json:"metadata"`
-		} `json:"items"`
+	return resolveClusterName(kcp.Name)
+}
+
+// patchClusterControlPlaneRef repoints the owning Cluster's spec.controlPlaneRef at the
+// newly rolled KubeadmControlPlane so CAPI starts reconciling machines against it
+func patchClusterControlPlaneRef(c crclient.Client, clusterName, newKCPName string) {
+	var cluster capiv1.Cluster
+	if err := c.Get(context.TODO(), crclient.ObjectKey{Namespace: namespace, Name: clusterName}, &cluster); err != nil {
+		log.Fatal("unable to get owning Cluster ", clusterName, ": ", err)
 	}
-	if err := json.Unmarshal(body, &kadmList); err != nil {
-		fmt.Fprintln(os.Stderr, "Error unmarshaling response:", err)
-		os.Exit(1)
+	original := cluster.DeepCopy()
+	if cluster.Spec.ControlPlaneRef == nil {
+		log.Fatal("Cluster ", clusterName, " has no controlPlaneRef to repoint")
 	}
-	var kubeadmcplist []string
-	for _, kadm := range kadmList.Items {
-		fmt.Println(kadm.Metadata.Name)
-		kubeadmcplist = append(kubeadmcplist, kadm.Metadata.Name)
+	cluster.Spec.ControlPlaneRef.Name = newKCPName
+	if err := patchWithDiff(c, &cluster, original); err != nil {
+		fmt.Println("unable to patch Cluster control-plane ref:", err)
 	}
-	fmt.Println(kubeadmcplist)
-	return kubeadmcplist
 }
 
-// appendKubeAdmCPCert appends the provided certificate to kubeadmcontrolplane object
-// future-implementation if MUTABLE
-func appendKubeAdmCPCert(client *http.Client, kadmcp string) {
-	url := KUBEADMCONTROLPLANE + kadmcp
-	req, err := client.Get(kubeapiserver + url)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			panic(err)
+// waitForControlPlaneRollout polls the new KubeadmControlPlane until CAPI reports it Ready
+// with every replica updated (the same maxSurge:1, one-by-one semantics the KCP controller
+// already enforces), and reports whether that happened before waitTimeout so callers can
+// refuse to touch the old KCP on timeout
+func waitForControlPlaneRollout(c crclient.Client, newKCPName string) bool {
+	const (
+		pollInterval = 10 * time.Second
+		waitTimeout  = 30 * time.Minute
+	)
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		var kcp kcpv1.KubeadmControlPlane
+		if err := c.Get(context.TODO(), crclient.ObjectKey{Namespace: namespace, Name: newKCPName}, &kcp); err != nil {
+			log.Fatal("unable to get rolled kubeadmcontrolplane ", newKCPName, ": ", err)
 		}
-	}(req.Body)
-	if req.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Unexpected status code:", req.StatusCode)
-		os.Exit(1)
+		fmt.Printf("Rollout progress for %s: updatedReplicas=%d replicas=%d ready=%t\n",
+			newKCPName, kcp.Status.UpdatedReplicas, kcp.Status.Replicas, kcp.Status.Ready)
+		if kcp.Status.Ready && kcp.Status.UpdatedReplicas == kcp.Status.Replicas {
+			return true
+		}
+		time.Sleep(pollInterval)
 	}
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response body:", err)
-		os.Exit(1)
+	fmt.Fprintln(os.Stderr, "Timed out waiting for control-plane rollout of", newKCPName)
+	return false
+}
+
+// rollKubeAdmControlPlane deep-copies the existing (largely immutable) KubeadmControlPlane
+// into a new object named <kadmcp>-ca-<shortsha>, applies mutate to its KubeadmConfigSpec,
+// creates the new revision, repoints the owning Cluster at it, waits for the rollout to
+// finish and then deletes the old KCP - this is the only way to get new PKI material onto
+// control-plane nodes once a cluster has been bootstrapped
+func rollKubeAdmControlPlane(c crclient.Client, kadmcp string, mutate func(kcp *kcpv1.KubeadmControlPlane)) {
+	var kcp kcpv1.KubeadmControlPlane
+	if err := c.Get(context.TODO(), crclient.ObjectKey{Namespace: namespace, Name: kadmcp}, &kcp); err != nil {
+		log.Fatal("unable to get kubeadmcontrolplane ", kadmcp, ": ", err)
+	}
+	clusterName := getOwningClusterName(&kcp)
+
+	newKCP := kcp.DeepCopy()
+	newKCP.ObjectMeta = metav1.ObjectMeta{
+		Name:            fmt.Sprintf("%s-ca-%s", kadmcp, shortRevision(certcontent)),
+		Namespace:       namespace,
+		Labels:          kcp.Labels,
+		OwnerReferences: kcp.OwnerReferences,
+	}
+	newKCP.Status = kcpv1.KubeadmControlPlaneStatus{}
+
+	mutate(newKCP)
+
+	if dryRun {
+		fmt.Printf("[dry-run] would create kubeadmcontrolplane %s/%s, repoint Cluster %s at it, wait for rollout, then delete %s\n",
+			newKCP.Namespace, newKCP.Name, clusterName, kcp.Name)
+		return
 	}
 
-	if err := json.Unmarshal(body, &KubeadmControlPlane); err != nil {
-		fmt.Fprintln(os.Stderr, "Error unmarshaling response:", err)
-		os.Exit(1)
+	if err := c.Create(context.TODO(), newKCP); err != nil {
+		fmt.Println("unable to create rolled kubeadmcontrolplane:", err)
+		return
+	}
+
+	patchClusterControlPlaneRef(c, clusterName, newKCP.Name)
+
+	if !waitForControlPlaneRollout(c, newKCP.Name) {
+		fmt.Fprintln(os.Stderr, "rollout of", newKCP.Name, "did not succeed, leaving superseded kubeadmcontrolplane", kcp.Name, "in place")
+		return
+	}
+
+	if err := c.Delete(context.TODO(), &kcp); err != nil {
+		fmt.Println("unable to delete superseded kubeadmcontrolplane:", err)
+	}
+}
+
+// appendKubeAdmCPCert rolls a new KubeadmControlPlane revision with the provided
+// certificate merged into its Files / PreKubeadmCommands
+func appendKubeAdmCPCert(c crclient.Client, kadmcp string) {
+	rollKubeAdmControlPlane(c, kadmcp, func(newKCP *kcpv1.KubeadmControlPlane) {
+		newFile := bootstrapv1.File{
+			Content:     certcontent,
+			Owner:       "root",
+			Path:        "/etc/ssl/certs/tkg-custom-ca.pem",
+			Permissions: "0644",
+		}
+		fmt.Println(newFile)
+		newKCP.Spec.KubeadmConfigSpec.Files = append(newKCP.Spec.KubeadmConfigSpec.Files, newFile)
+		newKCP.Spec.KubeadmConfigSpec.PreKubeadmCommands = []string{"'! which rehash_ca_certificates.sh 2>/dev/null || rehash_ca_certificates.sh'", "'! which update-ca-certificates 2>/dev/null || (mv /etc/ssl/certs/tkg-custom-ca.pem /usr/local/share/ca-certificates/tkg-custom-ca.crt && update-ca-certificates)'"}
+	})
+}
+
+// deleteKubeAdmCPCerts rolls a new KubeadmControlPlane revision with the managed
+// certificate removed from its Files, leaving every other file in place
+func deleteKubeAdmCPCerts(c crclient.Client, kadmcp string) {
+	rollKubeAdmControlPlane(c, kadmcp, func(newKCP *kcpv1.KubeadmControlPlane) {
+		files := newKCP.Spec.KubeadmConfigSpec.Files[:0]
+		for _, v := range newKCP.Spec.KubeadmConfigSpec.Files {
+			if v.Content != certcontent {
+				files = append(files, v)
+			}
+		}
+		newKCP.Spec.KubeadmConfigSpec.Files = files
+		newKCP.Spec.KubeadmConfigSpec.PreKubeadmCommands = []string{"'! which rehash_ca_certificates.sh 2>/dev/null || rehash_ca_certificates.sh'", "'! which update-ca-certificates 2>/dev/null || (mv /etc/ssl/certs/tkg-custom-ca.pem /usr/local/share/ca-certificates/tkg-custom-ca.crt && update-ca-certificates)'"}
+	})
+}
+
+// getkubeadmconfigTemplatesList returns the names of every kubeadmconfigtemplate in
+// namespace, scoped to --cluster-name when set
+func getkubeadmconfigTemplatesList(c crclient.Client) []string {
+	var templateList bootstrapv1.KubeadmConfigTemplateList
+	if err := c.List(context.TODO(), &templateList, crclient.InNamespace(namespace)); err != nil {
+		log.Fatal("unable to list kubeadmconfigtemplates: ", err)
+	}
+	var names []string
+	for _, kadm := range templateList.Items {
+		if !belongsToTargetCluster(kadm.Labels) {
+			continue
+		}
+		fmt.Println(kadm.Name)
+		names = append(names, kadm.Name)
+	}
+	return names
+}
+
+// appendKubeAdmCert merges the managed cert into a kubeadmconfigtemplate's Files
+func appendKubeAdmCert(c crclient.Client, kadmdep string) {
+	var template bootstrapv1.KubeadmConfigTemplate
+	if err := c.Get(context.TODO(), crclient.ObjectKey{Namespace: namespace, Name: kadmdep}, &template); err != nil {
+		log.Fatal("unable to get kubeadmconfigtemplate ", kadmdep, ": ", err)
 	}
-	newFile := struct {
-		Content     string `json:"content"`
-		Owner       string `json:"owner"`
-		Path        string `json:"path"`
-		Permissions string `json:"permissions"`
-	}{
+	original := template.DeepCopy()
+
+	newFile := bootstrapv1.File{
 		Content:     certcontent,
 		Owner:       "root",
 		Path:        "/etc/ssl/certs/tkg-custom-ca.pem",
 		Permissions: "0644",
 	}
 
-	fmt.Println(newFile)
+	template.Spec.Template.Spec.Files = append(template.Spec.Template.Spec.Files, newFile)
+	template.Spec.Template.Spec.PreKubeadmCommands = []string{"'! which rehash_ca_certificates.sh 2>/dev/null || rehash_ca_certificates.sh'", "'! which update-ca-certificates 2>/dev/null || (mv /etc/ssl/certs/tkg-custom-ca.pem /usr/local/share/ca-certificates/tkg-custom-ca.crt && update-ca-certificates)'"}
+
+	if err := patchWithDiff(c, &template, original); err != nil {
+		log.Fatal("unable to patch kubeadmconfigtemplate ", kadmdep, ": ", err)
+	}
+	fmt.Println("patched kubeadmconfigtemplate", kadmdep)
+}
+
+// deleteKubeAdmConfigCerts removes the managed cert from a kubeadmconfigtemplate's Files
+func deleteKubeAdmConfigCerts(c crclient.Client, kadmdep string) {
+	var template bootstrapv1.KubeadmConfigTemplate
+	if err := c.Get(context.TODO(), crclient.ObjectKey{Namespace: namespace, Name: kadmdep}, &template); err != nil {
+		log.Fatal("unable to get kubeadmconfigtemplate ", kadmdep, ": ", err)
+	}
+	original := template.DeepCopy()
 
-	KubeadmControlPlane.Spec.KubeadmConfigSpec.Files = append(KubeadmControlPlane.Spec.KubeadmConfigSpec.Files, newFile)
-	KubeadmControlPlane.Spec.KubeadmConfigSpec.PreKubeadmCommands = []string{"'! which rehash_ca_certificates.sh 2>/dev/null || rehash_ca_certificates.sh'", "'! which update-ca-certificates 2>/dev/null || (mv /etc/ssl/certs/tkg-custom-ca.pem /usr/local/share/ca-certificates/tkg-custom-ca.crt && update-ca-certificates)'"}
+	files := template.Spec.Template.Spec.Files[:0]
+	for _, v := range template.Spec.Template.Spec.Files {
+		if v.Content != certcontent {
+			files = append(files, v)
+		}
+	}
+	template.Spec.Template.Spec.Files = files
+	template.Spec.Template.Spec.PreKubeadmCommands = []string{"'! which rehash_ca_certificates.sh 2>/dev/null || rehash_ca_certificates.sh'", "'! which update-ca-certificates 2>/dev/null || (mv /etc/ssl/certs/tkg-custom-ca.pem /usr/local/share/ca-certificates/tkg-custom-ca.crt && update-ca-certificates)'"}
 
-	data, err := json.Marshal(KubeadmControlPlane)
+	if err := patchWithDiff(c, &template, original); err != nil {
+		log.Fatal("unable to patch kubeadmconfigtemplate ", kadmdep, ": ", err)
+	}
+	fmt.Println("patched kubeadmconfigtemplate", kadmdep)
+}
+
+// getMachineDeployments returns the names of every machinedeployment in namespace, scoped
+// to --cluster-name when set
+func getMachineDeployments(c crclient.Client) []string {
+	var mdList capiv1.MachineDeploymentList
+	if err := c.List(context.TODO(), &mdList, crclient.InNamespace(namespace)); err != nil {
+		log.Fatal("unable to list machinedeployments: ", err)
+	}
+	var names []string
+	for _, md := range mdList.Items {
+		if !belongsToTargetCluster(md.Labels) {
+			continue
+		}
+		fmt.Println(md.Name)
+		names = append(names, md.Name)
+	}
+	return names
+}
+
+// mergeMachineDeployments bumps the rollout annotation on a machinedeployment's machine
+// template so CAPI rolls the worker nodes to pick up the new cert
+func mergeMachineDeployments(c crclient.Client, mcdep string) {
+	var md capiv1.MachineDeployment
+	if err := c.Get(context.TODO(), crclient.ObjectKey{Namespace: namespace, Name: mcdep}, &md); err != nil {
+		log.Fatal("unable to get machinedeployment ", mcdep, ": ", err)
+	}
+	original := md.DeepCopy()
+
+	if md.Spec.Template.ObjectMeta.Annotations == nil {
+		md.Spec.Template.ObjectMeta.Annotations = map[string]string{}
+	}
+	md.Spec.Template.ObjectMeta.Annotations["date"] = time.Now().Format("Wed Feb 25 11:06:39 PST 2015")
+	md.Spec.Template.ObjectMeta.Annotations["run.tanzu.vmware.com/resolve-os-image"] = "run.tanzu.vmware.com/resolve-os-image"
+
+	if err := patchWithDiff(c, &md, original); err != nil {
+		fmt.Println("unable to patch machinedeployment:", err)
+		return
+	}
+	fmt.Println("patched machinedeployment", mcdep)
+}
+
+// patchWithDiff applies a merge-patch, or under --dry-run prints the patch that would be
+// applied (a strategic merge patch, falling back to a plain JSON diff) without calling Patch
+func patchWithDiff(c crclient.Client, obj crclient.Object, original crclient.Object) error {
+	if !dryRun {
+		return c.Patch(context.TODO(), obj, crclient.MergeFrom(original))
+	}
+
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return err
+	}
+	modifiedJSON, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	patch, err := strategicpatch.CreateTwoWayMergePatch(originalJSON, modifiedJSON, obj)
+	if err != nil {
+		fmt.Println("[dry-run] unable to compute strategic patch, falling back to plain diff:", err)
+		fmt.Println(cmp.Diff(string(originalJSON), string(modifiedJSON)))
+		return nil
+	}
+	fmt.Printf("[dry-run] %s/%s would be patched:\n%s\n", obj.GetNamespace(), obj.GetName(), string(patch))
+	return nil
+}
+
+
+const (
+	pkiAccessNamespace = "kube-system"
+	pkiAccessPodName   = "cclcmgr-pki-access"
+	pkiDir             = "/etc/kubernetes/pki"
+	apiServerManifest  = "/etc/kubernetes/manifests/kube-apiserver.yaml"
+	sanConfigMapName   = "cclcmgr-apiserver-sans"
+)
+
+// rotateAPIServerCert regenerates the kube-apiserver serving cert with the SANs supplied
+// on the command line merged with the previously persisted set, minus anything named in
+// removeSanFlags, and then merged with the cluster defaults, which are therefore always kept,
+// equivalent to what `sealos cert` does for a live cluster
+func rotateAPIServerCert(sanFlags, removeSanFlags []string) {
+	clientset, err := kubernetes.NewForConfig(kclient)
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	request, err := http.NewRequest("POST", kubeapiserver+url, bytes.NewBuffer(data))
+
+	dnsNames, ips := parseSANFlags(sanFlags)
+	persistedDNS, persistedIPs := loadSANConfigMap(clientset)
+	dnsNames = mergeStrings(dnsNames, persistedDNS)
+	ips = mergeIPs(ips, persistedIPs)
+
+	removeDNS, removeIPList := parseSANFlags(removeSanFlags)
+	dnsNames = subtractStrings(dnsNames, removeDNS)
+	ips = subtractIPs(ips, removeIPList)
+
+	defaultDNS, defaultIPs := discoverDefaultSANs(clientset)
+	dnsNames = mergeStrings(dnsNames, defaultDNS)
+	ips = mergeIPs(ips, defaultIPs)
+
+	nodeName := getControlPlaneNodeName(clientset)
+	if dryRun {
+		fmt.Println("[dry-run] would re-sign the kube-apiserver serving cert on control-plane node", nodeName, "with SANs:", dnsNames, ips)
+		return
+	}
+	fmt.Println("Staging PKI access pod on control-plane node", nodeName)
+	createPKIAccessPod(clientset, nodeName)
+	defer deletePKIAccessPod(clientset)
+
+	apiserverCertPEM, err := readRemoteFile(pkiDir + "/apiserver.crt")
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	request.Header = map[string][]string{"Content-type": {" application/json"}}
-	resp, err := client.Do(request)
+	caCertPEM, err := readRemoteFile(pkiDir + "/ca.crt")
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	defer resp.Body.Close()
-	bodyr, err := io.ReadAll(resp.Body)
+	caKeyPEM, err := readRemoteFile(pkiDir + "/ca.key")
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	fmt.Println(string(bodyr))
-}
 
-// deleteKubeAdmCPCerts deletes all the certificates in kubeadmcontrolplane object
-// future-implementation if MUTABLE
-func deleteKubeAdmCPCerts(client *http.Client, kadmcp string) {
-	url := KUBEADMCONTROLPLANE + kadmcp
-	req, err := client.Get(kubeapiserver + url)
+	existingCert, err := parseCertificatePEM(apiserverCertPEM)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("unable to parse existing apiserver.crt:", err)
+		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			panic(err)
-		}
-	}(req.Body)
-	if req.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Unexpected status code:", req.StatusCode)
-		os.Exit(1)
+	caCert, err := parseCertificatePEM(caCertPEM)
+	if err != nil {
+		fmt.Println("unable to parse ca.crt:", err)
+		return
 	}
-	body, err := io.ReadAll(req.Body)
+	caKey, err := parsePrivateKeyPEM(caKeyPEM)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response body:", err)
-		os.Exit(1)
+		fmt.Println("unable to parse ca.key:", err)
+		return
 	}
 
-	if err := json.Unmarshal(body, &KubeadmControlPlane); err != nil {
-		fmt.Fprintln(os.Stderr, "Error unmarshaling response:", err)
-		os.Exit(1)
+	newCertPEM, newKeyPEM, err := signAPIServerCert(existingCert, caCert, caKey, dnsNames, ips)
+	if err != nil {
+		fmt.Println("unable to sign new apiserver cert:", err)
+		return
 	}
 
-	KubeadmControlPlane.Spec.KubeadmConfigSpec.Files = KubeadmControlPlane.Spec.KubeadmConfigSpec.Files[:0]
-	KubeadmControlPlane.Spec.KubeadmConfigSpec.PreKubeadmCommands = []string{"'! which rehash_ca_certificates.sh 2>/dev/null || rehash_ca_certificates.sh'", "'! which update-ca-certificates 2>/dev/null || (mv /etc/ssl/certs/tkg-custom-ca.pem /usr/local/share/ca-certificates/tkg-custom-ca.crt && update-ca-certificates)'"}
-	data, err := json.Marshal(KubeadmControlPlane)
+	// stage both files and only rename into place once the staged cert verifies
+	// against the CA, so a half-written pair never gets picked up by kubelet
+	writeRemoteFile(pkiDir+"/apiserver.crt.new", newCertPEM)
+	writeRemoteFile(pkiDir+"/apiserver.key.new", newKeyPEM)
 
-	request, err := http.NewRequest("PATCH", kubeapiserver+url, bytes.NewBuffer(data))
-	if err != nil {
-		fmt.Println(err)
+	if err := verifyCertAgainstCA(newCertPEM, caCertPEM); err != nil {
+		fmt.Println("staged apiserver cert failed verification against the CA, aborting:", err)
+		return
 	}
-	request.Header = map[string][]string{"Content-type": {" application/merge-patch+json"}}
-	resp, err := client.Do(request)
-	if err != nil {
-		fmt.Println(err)
+
+	execOrPrint(fmt.Sprintf("mv %s/apiserver.crt.new %s/apiserver.crt", pkiDir, pkiDir))
+	execOrPrint(fmt.Sprintf("mv %s/apiserver.key.new %s/apiserver.key", pkiDir, pkiDir))
+	execOrPrint(fmt.Sprintf("touch %s", apiServerManifest))
+
+	persistSANConfigMap(clientset, dnsNames, ips)
+	fmt.Println("kube-apiserver serving cert rotated with SANs:", dnsNames, ips)
+}
+
+// parseSANFlags turns repeated --san host=foo / --san ip=1.2.3.4 entries into
+// separate DNS name and IP address lists
+func parseSANFlags(sanFlags []string) ([]string, []net.IP) {
+	var dnsNames []string
+	var ips []net.IP
+	for _, san := range sanFlags {
+		parts := strings.SplitN(san, "=", 2)
+		if len(parts) != 2 {
+			fmt.Println("ignoring malformed --san entry:", san)
+			continue
+		}
+		switch parts[0] {
+		case "host":
+			dnsNames = append(dnsNames, parts[1])
+		case "ip":
+			if ip := net.ParseIP(parts[1]); ip != nil {
+				ips = append(ips, ip)
+			} else {
+				fmt.Println("ignoring invalid --san ip entry:", san)
+			}
+		default:
+			fmt.Println("ignoring unknown --san prefix:", san)
+		}
 	}
-	defer resp.Body.Close()
-	bodyr, err := io.ReadAll(resp.Body)
+	return dnsNames, ips
+}
+
+// discoverDefaultSANs reconstructs the SANs kubeadm puts on the apiserver cert by
+// default: the in-cluster service names, the first address of the service CIDR, and
+// every node's internal IP
+func discoverDefaultSANs(clientset *kubernetes.Clientset) ([]string, []net.IP) {
+	dnsNames := []string{"kubernetes", "kubernetes.default", "kubernetes.default.svc", "kubernetes.default.svc.cluster.local"}
+	var ips []net.IP
+
+	if svc, err := clientset.CoreV1().Services("default").Get(context.TODO(), "kubernetes", metav1.GetOptions{}); err == nil {
+		if ip := net.ParseIP(svc.Spec.ClusterIP); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println("unable to list nodes for default SANs:", err)
+		return dnsNames, ips
+	}
+	for _, node := range nodes.Items {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == v1.NodeInternalIP {
+				if ip := net.ParseIP(addr.Address); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
 	}
-	fmt.Println(string(bodyr))
+	return dnsNames, ips
+}
+
+// getControlPlaneNodeName returns the first node labeled as a control-plane, which is
+// where the PKI access pod needs to be scheduled to reach /etc/kubernetes/pki
+func getControlPlaneNodeName(clientset *kubernetes.Clientset) string {
+	nodes, err := clientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{
+		LabelSelector: "node-role.kubernetes.io/control-plane",
+	})
+	if err != nil || len(nodes.Items) == 0 {
+		log.Fatal("unable to find a control-plane node", err)
+	}
+	return nodes.Items[0].Name
 }
 
-// getkubeadmconfigTemplatesList returns all kubeadmconfigtemplatelist object names
-func getkubeadmconfigTemplatesList(client *http.Client) []string {
-	resp, err := client.Get(kubeapiserver + KUBEADMCONFIGTEMPLATE)
+// createPKIAccessPod applies a privileged pod pinned to nodeName with the host's PKI and
+// static-pod manifest directories mounted, giving us a kubectl-exec style window into
+// the control-plane filesystem without needing a DaemonSet for a one-shot rotation
+func createPKIAccessPod(clientset *kubernetes.Clientset, nodeName string) {
+	hostPathDirectory := v1.HostPathDirectory
+	privileged := true
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pkiAccessPodName,
+			Namespace: pkiAccessNamespace,
+		},
+		Spec: v1.PodSpec{
+			NodeName:      nodeName,
+			HostNetwork:   true,
+			RestartPolicy: v1.RestartPolicyNever,
+			Tolerations: []v1.Toleration{
+				{Operator: v1.TolerationOpExists},
+			},
+			Containers: []v1.Container{
+				{
+					Name:            "pki-access",
+					Image:           "busybox:stable",
+					Command:         []string{"sleep", "3600"},
+					SecurityContext: &v1.SecurityContext{Privileged: &privileged},
+					VolumeMounts: []v1.VolumeMount{
+						{Name: "pki", MountPath: pkiDir},
+						{Name: "manifests", MountPath: "/etc/kubernetes/manifests"},
+					},
+				},
+			},
+			Volumes: []v1.Volume{
+				{Name: "pki", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: pkiDir, Type: &hostPathDirectory}}},
+				{Name: "manifests", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/etc/kubernetes/manifests", Type: &hostPathDirectory}}},
+			},
+		},
+	}
+	_, err := clientset.CoreV1().Pods(pkiAccessNamespace).Create(context.TODO(), pod, metav1.CreateOptions{})
 	if err != nil {
-		log.Fatal("unable to retrieve with the given object", err)
+		log.Fatal("unable to create pki-access pod:", err)
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			panic(err)
+	waitForPodRunning(clientset)
+}
+
+// waitForPodRunning polls the pki-access pod until kubelet reports it Running
+func waitForPodRunning(clientset *kubernetes.Clientset) {
+	for i := 0; i < 60; i++ {
+		p, err := clientset.CoreV1().Pods(pkiAccessNamespace).Get(context.TODO(), pkiAccessPodName, metav1.GetOptions{})
+		if err == nil && p.Status.Phase == v1.PodRunning {
+			return
 		}
-	}(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Unexpected status code:", resp.StatusCode)
-		os.Exit(1)
-	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response body:", err)
-		os.Exit(1)
+		time.Sleep(2 * time.Second)
 	}
-	var kadmList struct {
-		Items []struct {
-			Metadata struct {
-				Name string `json:"name"`
-			} `json:"metadata"`
-		} `json:"items"`
+	log.Fatal("timed out waiting for pki-access pod to start")
+}
+
+// deletePKIAccessPod tears down the temporary pod once the rotation is complete
+func deletePKIAccessPod(clientset *kubernetes.Clientset) {
+	if err := clientset.CoreV1().Pods(pkiAccessNamespace).Delete(context.TODO(), pkiAccessPodName, metav1.DeleteOptions{}); err != nil {
+		fmt.Println("unable to delete pki-access pod:", err)
 	}
-	if err := json.Unmarshal(body, &kadmList); err != nil {
-		fmt.Fprintln(os.Stderr, "Error unmarshaling response:", err)
-		os.Exit(1)
+}
+
+// execInPod runs command inside the pki-access pod and returns its stdout, the same
+// mechanism `kubectl exec` itself uses under the hood
+func execInPod(command []string) (string, error) {
+	req := kubeclientset().CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pkiAccessPodName).
+		Namespace(pkiAccessNamespace).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Command: command,
+			Stdout:  true,
+			Stderr:  true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(kclient, "POST", req.URL())
+	if err != nil {
+		return "", err
 	}
-	var kubeadmlist []string
-	for _, kadm := range kadmList.Items {
-		fmt.Println(kadm.Metadata.Name)
-		kubeadmlist = append(kubeadmlist, kadm.Metadata.Name)
+	var stdout, stderr bytes.Buffer
+	err = executor.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, stderr.String())
 	}
-	return kubeadmlist
+	return stdout.String(), nil
 }
 
-// appendKubeAdmCert updates kubeadm object
-func appendKubeAdmCert(client *http.Client, kadmdep string) {
-	url := KUBEADMCONFIGTEMPLATE + kadmdep
-	req, err := client.Get(kubeapiserver + url)
+// kubeclientset builds a clientset from the shared rest.Config, reused by execInPod so
+// we don't have to thread a *kubernetes.Clientset through every call site
+func kubeclientset() *kubernetes.Clientset {
+	clientset, err := kubernetes.NewForConfig(kclient)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			panic(err)
-		}
-	}(req.Body)
-	if req.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Unexpected status code:", req.StatusCode)
-		os.Exit(1)
+	return clientset
+}
+
+// execOrPrint runs a shell command in the pki-access pod and prints any failure rather
+// than aborting the rotation that has already staged a verified cert
+func execOrPrint(shellCmd string) {
+	if _, err := execInPod([]string{"sh", "-c", shellCmd}); err != nil {
+		fmt.Println("command failed:", shellCmd, err)
 	}
-	body, err := io.ReadAll(req.Body)
+}
+
+// readRemoteFile cats path out of the pki-access pod. Errors are returned rather than
+// fataled so callers can still run their deferred cleanup of the pki-access pod
+func readRemoteFile(path string) ([]byte, error) {
+	out, err := execInPod([]string{"cat", path})
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response body:", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("unable to read remote file %s: %w", path, err)
 	}
+	return []byte(out), nil
+}
 
-	if err := json.Unmarshal(body, &KubeadmConfigTemplate); err != nil {
-		fmt.Fprintln(os.Stderr, "Error unmarshaling response:", err)
-		os.Exit(1)
-	}
-	newFile := struct {
-		Content     string `json:"content"`
-		Owner       string `json:"owner"`
-		Path        string `json:"path"`
-		Permissions string `json:"permissions"`
-	}{
-		Content:     certcontent,
-		Owner:       "root",
-		Path:        "/etc/ssl/certs/tkg-custom-ca.pem",
-		Permissions: "0644",
+// writeRemoteFile writes content to path inside the pki-access pod via a shell redirect
+func writeRemoteFile(path string, content []byte) {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	shellCmd := fmt.Sprintf("echo %s | base64 -d > %s", encoded, path)
+	execOrPrint(shellCmd)
+}
+
+// parseCertificatePEM decodes a single PEM-encoded certificate
+func parseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
 	}
+	return x509.ParseCertificate(block.Bytes)
+}
 
-	KubeadmConfigTemplate.Spec.Template.Spec.Files = append(KubeadmConfigTemplate.Spec.Template.Spec.Files, newFile)
+// parsePrivateKeyPEM decodes a PEM-encoded CA key, trying PKCS1 and PKCS8 in turn since
+// kubeadm-generated CA keys are usually PKCS1 RSA but PKCS8 is also valid
+func parsePrivateKeyPEM(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("ca.key is not an RSA key")
+	}
+	return rsaKey, nil
+}
 
-	KubeadmConfigTemplate.Spec.Template.Spec.PreKubeadmCommands = []string{"'! which rehash_ca_certificates.sh 2>/dev/null || rehash_ca_certificates.sh'", "'! which update-ca-certificates 2>/dev/null || (mv /etc/ssl/certs/tkg-custom-ca.pem /usr/local/share/ca-certificates/tkg-custom-ca.crt && update-ca-certificates)'"}
-	data, err := json.Marshal(KubeadmConfigTemplate)
+// signAPIServerCert builds a new serving cert template that copies Subject, KeyUsage and
+// NotBefore off the existing apiserver cert but replaces DNSNames/IPAddresses with the
+// merged SAN set, then re-signs it with the cluster CA
+func signAPIServerCert(existing, caCert *x509.Certificate, caKey *rsa.PrivateKey, dnsNames []string, ips []net.IP) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	request, err := http.NewRequest("PATCH", kubeapiserver+url, bytes.NewBuffer(data))
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	request.Header = map[string][]string{"Content-type": {" application/merge-patch+json"}}
-	resp, err := client.Do(request)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      existing.Subject,
+		NotBefore:    existing.NotBefore,
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     existing.KeyUsage,
+		ExtKeyUsage:  existing.ExtKeyUsage,
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	defer resp.Body.Close()
-	bodyr, err := io.ReadAll(resp.Body)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+// verifyCertAgainstCA confirms the newly staged cert actually chains up to the cluster
+// CA before it gets renamed into place over the live apiserver.crt
+func verifyCertAgainstCA(certPEM, caCertPEM []byte) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCertPEM) {
+		return fmt.Errorf("unable to load CA cert into pool")
+	}
+	cert, err := parseCertificatePEM(certPEM)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	fmt.Println(string(bodyr))
+	_, err = cert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	return err
 }
 
-// deleteKubeAdmCerts deletes the existing certificates from kubeadmobjects
-func deleteKubeAdmConfigCerts(client *http.Client, kadmdep string) {
-	url := KUBEADMCONFIGTEMPLATE + kadmdep
-	req, err := client.Get(kubeapiserver + url)
+// loadSANConfigMap reads the previously persisted SAN set so a second `altnames`
+// invocation can add to or remove from it idempotently instead of starting from scratch
+func loadSANConfigMap(clientset *kubernetes.Clientset) ([]string, []net.IP) {
+	cm, err := clientset.CoreV1().ConfigMaps(pkiAccessNamespace).Get(context.TODO(), sanConfigMapName, metav1.GetOptions{})
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			panic(err)
+	var dnsNames []string
+	var ips []net.IP
+	if raw, ok := cm.Data["dnsNames"]; ok && raw != "" {
+		dnsNames = strings.Split(raw, ",")
+	}
+	if raw, ok := cm.Data["ipAddresses"]; ok && raw != "" {
+		for _, s := range strings.Split(raw, ",") {
+			if ip := net.ParseIP(s); ip != nil {
+				ips = append(ips, ip)
+			}
 		}
-	}(req.Body)
-	if req.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Unexpected status code:", req.StatusCode)
-		os.Exit(1)
 	}
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response body:", err)
-		os.Exit(1)
+	return dnsNames, ips
+}
+
+// persistSANConfigMap writes the merged SAN set back to kube-system so it survives
+// across invocations of the altnames action
+func persistSANConfigMap(clientset *kubernetes.Clientset, dnsNames []string, ips []net.IP) {
+	var ipStrings []string
+	for _, ip := range ips {
+		ipStrings = append(ipStrings, ip.String())
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sanConfigMapName,
+			Namespace: pkiAccessNamespace,
+		},
+		Data: map[string]string{
+			"dnsNames":    strings.Join(dnsNames, ","),
+			"ipAddresses": strings.Join(ipStrings, ","),
+		},
+	}
+	if _, err := clientset.CoreV1().ConfigMaps(pkiAccessNamespace).Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		if _, err := clientset.CoreV1().ConfigMaps(pkiAccessNamespace).Create(context.TODO(), cm, metav1.CreateOptions{}); err != nil {
+			fmt.Println("unable to persist SAN ConfigMap:", err)
+		}
+	}
+}
+
+// mergeStrings de-duplicates and concatenates string slices, preserving first-seen order
+func mergeStrings(sets ...[]string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, set := range sets {
+		for _, s := range set {
+			if !seen[s] {
+				seen[s] = true
+				out = append(out, s)
+			}
+		}
 	}
+	return out
+}
 
-	if err := json.Unmarshal(body, &KubeadmConfigTemplate); err != nil {
-		fmt.Fprintln(os.Stderr, "Error unmarshaling response:", err)
-		os.Exit(1)
+// mergeIPs de-duplicates and concatenates net.IP slices, preserving first-seen order
+func mergeIPs(sets ...[]net.IP) []net.IP {
+	seen := map[string]bool{}
+	var out []net.IP
+	for _, set := range sets {
+		for _, ip := range set {
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				out = append(out, ip)
+			}
+		}
 	}
+	return out
+}
 
-	for i, v := range KubeadmConfigTemplate.Spec.Template.Spec.Files {
-		if v.Content == certcontent {
-			KubeadmConfigTemplate.Spec.Template.Spec.Files = append(KubeadmConfigTemplate.Spec.Template.Spec.Files[:i], KubeadmConfigTemplate.Spec.Template.Spec.Files[i+1:]...)
+// subtractStrings drops any entry of remove from set, preserving set's order
+func subtractStrings(set, remove []string) []string {
+	drop := map[string]bool{}
+	for _, s := range remove {
+		drop[s] = true
+	}
+	var out []string
+	for _, s := range set {
+		if !drop[s] {
+			out = append(out, s)
 		}
 	}
-	//KubeadmConfigTemplate.Spec.Template.Spec.Files = KubeadmConfigTemplate.Spec.Template.Spec.Files[:0]
-	KubeadmConfigTemplate.Spec.Template.Spec.PreKubeadmCommands = []string{"'! which rehash_ca_certificates.sh 2>/dev/null || rehash_ca_certificates.sh'", "'! which update-ca-certificates 2>/dev/null || (mv /etc/ssl/certs/tkg-custom-ca.pem /usr/local/share/ca-certificates/tkg-custom-ca.crt && update-ca-certificates)'"}
-	data, err := json.Marshal(KubeadmConfigTemplate)
+	return out
+}
+
+// subtractIPs drops any entry of remove from set, preserving set's order
+func subtractIPs(set, remove []net.IP) []net.IP {
+	drop := map[string]bool{}
+	for _, ip := range remove {
+		drop[ip.String()] = true
+	}
+	var out []net.IP
+	for _, ip := range set {
+		if !drop[ip.String()] {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
 
-	request, err := http.NewRequest("PATCH", kubeapiserver+url, bytes.NewBuffer(data))
+const (
+	inventoryNamespace     = "tkg-system"
+	inventoryConfigMapName = "cclcmgr-inventory"
+	inventoryDataKey       = "inventory"
+)
+
+// certInventoryEntry is one PEM certificate cclcmgr has installed, as stored in the
+// cclcmgr-inventory ConfigMap. `status` still re-reads the CAPI objects and the
+// kapp-controller-config Secret on every run and takes only InstallTimestamp from the stored entries
+type certInventoryEntry struct {
+	Fingerprint      string    `json:"fingerprint"`
+	Subject          string    `json:"subject"`
+	Issuer           string    `json:"issuer"`
+	NotAfter         time.Time `json:"notAfter"`
+	InstallTimestamp string    `json:"installTimestamp"`
+	PEM              string    `json:"pem"`
+}
+
+// fingerprintCert derives a stable key for a PEM blob so the inventory can dedupe and the
+// rotate action can reference a specific installed cert
+func fingerprintCert(pemBytes []byte) string {
+	sum := sha256.Sum256(pemBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadInventory reads the cclcmgr-inventory ConfigMap, returning nil if it hasn't been
+// created yet (eg. on a cluster that predates this feature)
+func loadInventory(clientset *kubernetes.Clientset) []certInventoryEntry {
+	cm, err := clientset.CoreV1().ConfigMaps(inventoryNamespace).Get(context.TODO(), inventoryConfigMapName, metav1.GetOptions{})
 	if err != nil {
-		log.Fatal(err)
+		return nil
+	}
+	var entries []certInventoryEntry
+	if raw, ok := cm.Data[inventoryDataKey]; ok {
+		if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+			fmt.Println("unable to parse cert inventory:", err)
+		}
 	}
-	request.Header = map[string][]string{"Content-type": {" application/merge-patch+json"}}
-	resp, err := client.Do(request)
+	return entries
+}
+
+// saveInventory persists the inventory back to its ConfigMap, creating it on first use
+func saveInventory(clientset *kubernetes.Clientset, entries []certInventoryEntry) {
+	data, err := json.Marshal(entries)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("unable to marshal cert inventory:", err)
+		return
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      inventoryConfigMapName,
+			Namespace: inventoryNamespace,
+		},
+		Data: map[string]string{inventoryDataKey: string(data)},
+	}
+	if _, err := clientset.CoreV1().ConfigMaps(inventoryNamespace).Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		if _, err := clientset.CoreV1().ConfigMaps(inventoryNamespace).Create(context.TODO(), cm, metav1.CreateOptions{}); err != nil {
+			fmt.Println("unable to persist cert inventory:", err)
+		}
 	}
-	defer resp.Body.Close()
-	bodyr, err := io.ReadAll(resp.Body)
+}
+
+// addToInventory records a newly installed cert, skipping it if already tracked
+func addToInventory(clientset *kubernetes.Clientset, pemBytes []byte) {
+	cert, err := parseCertificatePEM(pemBytes)
+	if err != nil {
+		fmt.Println("unable to parse cert for inventory:", err)
+		return
+	}
+	fp := fingerprintCert(pemBytes)
+	entries := loadInventory(clientset)
+	for _, e := range entries {
+		if e.Fingerprint == fp {
+			return
+		}
+	}
+	entries = append(entries, certInventoryEntry{
+		Fingerprint:      fp,
+		Subject:          cert.Subject.String(),
+		Issuer:           cert.Issuer.String(),
+		NotAfter:         cert.NotAfter,
+		InstallTimestamp: time.Now().Format(time.RFC3339),
+		PEM:              string(pemBytes),
+	})
+	saveInventory(clientset, entries)
+}
+
+// removeFromInventory drops a tracked cert once it has been deleted from the cluster
+func removeFromInventory(clientset *kubernetes.Clientset, fingerprint string) {
+	var kept []certInventoryEntry
+	for _, e := range loadInventory(clientset) {
+		if e.Fingerprint != fingerprint {
+			kept = append(kept, e)
+		}
+	}
+	saveInventory(clientset, kept)
+}
+
+// recordInventoryAppend is the append-action hook into the inventory, best-effort so a
+// ConfigMap problem never blocks the underlying cert rollout that already happened
+func recordInventoryAppend(pemBytes []byte) {
+	if dryRun {
+		fmt.Println("[dry-run] would record this cert in the cclcmgr-inventory ConfigMap")
+		return
+	}
+	clientset, err := kubernetes.NewForConfig(kclient)
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	fmt.Println(string(bodyr))
+	addToInventory(clientset, pemBytes)
 }
 
-// getMachineDeployments returns all the machinedpeloyments names
-func getMachineDeployments(client *http.Client) []string {
-	url := kubeapiserver + MACHINEDEPLOYMENT
-	resp, err := client.Get(url)
+// recordInventoryDelete is the delete-action counterpart to recordInventoryAppend
+func recordInventoryDelete(pemBytes []byte) {
+	if dryRun {
+		fmt.Println("[dry-run] would remove this cert from the cclcmgr-inventory ConfigMap")
+		return
+	}
+	clientset, err := kubernetes.NewForConfig(kclient)
 	if err != nil {
-		log.Fatal("unable to retrieve with the given object", err)
+		fmt.Println(err)
+		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
+	removeFromInventory(clientset, fingerprintCert(pemBytes))
+}
+
+// discoverInstalledCerts parses every PEM cclcmgr may have installed by reading the live
+// KubeadmConfigTemplate / KubeadmControlPlane Files and the kapp-controller-config Secret
+// directly, rather than trusting the cclcmgr-inventory ConfigMap - a pre-existing cert, a
+// manual edit, or a partially-failed append/delete would otherwise desync the cache from
+// reality. The ConfigMap is refreshed from this scan (except under --dry-run) and used purely
+// as an InstallTimestamp cache for certs this tool itself previously recorded.
+func discoverInstalledCerts(c crclient.Client, clientset *kubernetes.Clientset) []certInventoryEntry {
+	installTimestamps := map[string]string{}
+	for _, e := range loadInventory(clientset) {
+		installTimestamps[e.Fingerprint] = e.InstallTimestamp
+	}
+
+	seen := map[string]bool{}
+	var entries []certInventoryEntry
+	addPEM := func(pemBytes []byte) {
+		cert, err := parseCertificatePEM(pemBytes)
 		if err != nil {
-			panic(err)
+			return
 		}
-	}(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Unexpected status code:", resp.StatusCode)
-		os.Exit(1)
+		fp := fingerprintCert(pemBytes)
+		if seen[fp] {
+			return
+		}
+		seen[fp] = true
+		installTimestamp := installTimestamps[fp]
+		if installTimestamp == "" {
+			installTimestamp = "unknown (discovered from live cluster state)"
+		}
+		entries = append(entries, certInventoryEntry{
+			Fingerprint:      fp,
+			Subject:          cert.Subject.String(),
+			Issuer:           cert.Issuer.String(),
+			NotAfter:         cert.NotAfter,
+			InstallTimestamp: installTimestamp,
+			PEM:              string(pemBytes),
+		})
+	}
+
+	var templateList bootstrapv1.KubeadmConfigTemplateList
+	if err := c.List(context.TODO(), &templateList, crclient.InNamespace(namespace)); err != nil {
+		fmt.Println("unable to list kubeadmconfigtemplates for status:", err)
+	}
+	for _, t := range templateList.Items {
+		if !belongsToTargetCluster(t.Labels) {
+			continue
+		}
+		for _, f := range t.Spec.Template.Spec.Files {
+			addPEM([]byte(f.Content))
+		}
+	}
+
+	if !skipControlPlane {
+		var kcpList kcpv1.KubeadmControlPlaneList
+		if err := c.List(context.TODO(), &kcpList, crclient.InNamespace(namespace)); err != nil {
+			fmt.Println("unable to list kubeadmcontrolplanes for status:", err)
+		}
+		for _, k := range kcpList.Items {
+			if !belongsToTargetCluster(k.Labels) {
+				continue
+			}
+			for _, f := range k.Spec.KubeadmConfigSpec.Files {
+				addPEM([]byte(f.Content))
+			}
+		}
+	}
+
+	if secret, err := clientset.CoreV1().Secrets("tkg-system").Get(context.TODO(), "kapp-controller-config", metav1.GetOptions{}); err == nil {
+		if encoded, ok := secret.Data["certificate"]; ok {
+			if decoded, err := base64.StdEncoding.DecodeString(string(encoded)); err == nil {
+				addPEM(decoded)
+			}
+		}
+	}
+
+	if !dryRun {
+		saveInventory(clientset, entries)
 	}
-	body, err := io.ReadAll(resp.Body)
+	return entries
+}
+
+// certStatus reports Subject/Issuer/NotAfter/days-to-expiry for every cert cclcmgr finds
+// installed in the live cluster state
+func certStatus() {
+	clientset, err := kubernetes.NewForConfig(kclient)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response body:", err)
-		os.Exit(1)
+		fmt.Println(err)
+		return
+	}
+	entries := discoverInstalledCerts(k8sClient, clientset)
+	if len(entries) == 0 {
+		fmt.Println("No certs found installed in KubeadmConfigTemplate/KubeadmControlPlane Files or the kapp-controller-config Secret")
+		return
 	}
-	var mDepList struct {
-		Items []struct {
-			Metadata struct {
-				Name string `json:"name"`
-			} `json:"metadata"`
-		} `json:"items"`
+	for _, e := range entries {
+		daysLeft := int(time.Until(e.NotAfter).Hours() / 24)
+		fmt.Printf("Subject: %s\nIssuer: %s\nNotAfter: %s\nDays to expiry: %d\nInstalled: %s\nFingerprint: %s\n\n",
+			e.Subject, e.Issuer, e.NotAfter.Format(time.RFC3339), daysLeft, e.InstallTimestamp, e.Fingerprint)
 	}
-	if err := json.Unmarshal(body, &mDepList); err != nil {
-		_, err := fmt.Fprintln(os.Stderr, "Error unmarshaling response:", err)
-		if err != nil {
-			return nil
+}
+
+// deleteManagedCert runs the same delete path as the `delete` action over whatever PEM is
+// currently staged in certcontent, without requiring it to exist as a file on disk
+func deleteManagedCert() {
+	for _, kadm := range getkubeadmconfigTemplatesList(k8sClient) {
+		deleteKubeAdmConfigCerts(k8sClient, kadm)
+	}
+	if !skipControlPlane {
+		for _, kadmcp := range getkubeadmControlPlaneList(k8sClient) {
+			deleteKubeAdmCPCerts(k8sClient, kadmcp)
+		}
+	}
+	for _, md := range getMachineDeployments(k8sClient) {
+		fmt.Println("Applying MD", md)
+		mergeMachineDeployments(k8sClient, md)
+	}
+}
+
+// rotateCerts appends newCertPath and then deletes every managed cert whose NotAfter falls
+// within thresholdDays, producing the same MachineDeployment rollout append/delete already use
+func rotateCerts(newCertPath string, thresholdDays int) {
+	if newCertPath == "" {
+		fmt.Println("rotate requires --new-cert")
+		return
+	}
+	clientset, err := kubernetes.NewForConfig(kclient)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if !appendCerts(newCertPath) {
+		fmt.Println("append of", newCertPath, "failed, skipping rotation of expiring certs so the cluster isn't left without a valid trust bundle")
+		return
+	}
+
+	var newFingerprint string
+	if newCertBytes, err := os.ReadFile(newCertPath); err == nil {
+		newFingerprint = fingerprintCert(newCertBytes)
+	}
+	if !dryRun {
+		if !containsFingerprint(discoverInstalledCerts(k8sClient, clientset), newFingerprint) {
+			fmt.Println("new cert", newCertPath, "was not found installed after append, skipping rotation of expiring certs")
+			return
 		}
-		os.Exit(1)
 	}
-	var mdep []string
-	for _, kadm := range mDepList.Items {
-		fmt.Println(kadm.Metadata.Name)
-		mdep = append(mdep, kadm.Metadata.Name)
+
+	threshold := time.Now().AddDate(0, 0, thresholdDays)
+	for _, e := range discoverInstalledCerts(k8sClient, clientset) {
+		if e.Fingerprint == newFingerprint || !e.NotAfter.Before(threshold) {
+			continue
+		}
+		fmt.Println("rotating out expiring cert:", e.Subject, "NotAfter:", e.NotAfter)
+		certcontent = e.PEM
+		deleteManagedCert()
+		if !dryRun {
+			removeFromInventory(clientset, e.Fingerprint)
+		}
+	}
+}
+
+// containsFingerprint reports whether entries contains a cert matching fingerprint
+func containsFingerprint(entries []certInventoryEntry, fingerprint string) bool {
+	for _, e := range entries {
+		if e.Fingerprint == fingerprint {
+			return true
+		}
 	}
-	return mdep
+	return false
 }
 
-// mergeMachineDeployments merges the newly created annotation with the current date and time
-func mergeMachineDeployments(client *http.Client, mcdep string) {
+var certExpirySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cclcmgr_cert_expiry_seconds",
+	Help: "Seconds until a cclcmgr-managed certificate expires",
+}, []string{"subject"})
 
-	url := MACHINEDEPLOYMENT + mcdep
-	req, err := client.Get(kubeapiserver + url)
+// watchCertExpiry serves cclcmgr_cert_expiry_seconds on :9090/metrics and refreshes it from
+// the live cluster state (see discoverInstalledCerts) every interval, so operators can alert on upcoming expirations rather than
+// discovering them when kubelet TLS handshakes start failing
+func watchCertExpiry(interval time.Duration) {
+	clientset, err := kubernetes.NewForConfig(kclient)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println(err)
+		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
+	prometheus.MustRegister(certExpirySeconds)
+
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		if err := http.ListenAndServe(":9090", mux); err != nil {
+			log.Fatal("metrics server failed: ", err)
+		}
+	}()
+
+	for {
+		for _, e := range discoverInstalledCerts(k8sClient, clientset) {
+			certExpirySeconds.WithLabelValues(e.Subject).Set(time.Until(e.NotAfter).Seconds())
+		}
+		fmt.Println("Updated cert expiry metrics, next check in", interval)
+		time.Sleep(interval)
+	}
+}
+
+const backupNamespace = "tkg-system"
+
+// backupObject is one captured object inside a cclcmgr-backup Secret, tagged with enough
+// to Get it back and re-apply its Spec on rollback
+type backupObject struct {
+	Kind      string          `json:"kind"`
+	Namespace string          `json:"namespace"`
+	Name      string          `json:"name"`
+	Spec      json.RawMessage `json:"spec"`
+}
+
+// snapshotObjects captures the current KubeadmConfigTemplate / KubeadmControlPlane /
+// MachineDeployment objects in namespace so a mistaken append/delete can be undone later
+func snapshotObjects(c crclient.Client) []backupObject {
+	var snapshot []backupObject
+
+	var templateList bootstrapv1.KubeadmConfigTemplateList
+	if err := c.List(context.TODO(), &templateList, crclient.InNamespace(namespace)); err != nil {
+		fmt.Println("unable to list kubeadmconfigtemplates for backup:", err)
+	}
+	for _, t := range templateList.Items {
+		spec, err := json.Marshal(t.Spec)
 		if err != nil {
-			panic(err)
+			fmt.Println("unable to marshal kubeadmconfigtemplate", t.Name, "for backup:", err)
+			continue
 		}
-	}(req.Body)
-	if req.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Unexpected status code:", req.StatusCode)
-		os.Exit(1)
+		snapshot = append(snapshot, backupObject{Kind: "KubeadmConfigTemplate", Namespace: t.Namespace, Name: t.Name, Spec: spec})
 	}
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error reading response body:", err)
-		os.Exit(1)
+
+	if !skipControlPlane {
+		var kcpList kcpv1.KubeadmControlPlaneList
+		if err := c.List(context.TODO(), &kcpList, crclient.InNamespace(namespace)); err != nil {
+			fmt.Println("unable to list kubeadmcontrolplanes for backup:", err)
+		}
+		for _, k := range kcpList.Items {
+			spec, err := json.Marshal(k.Spec)
+			if err != nil {
+				fmt.Println("unable to marshal kubeadmcontrolplane", k.Name, "for backup:", err)
+				continue
+			}
+			snapshot = append(snapshot, backupObject{Kind: "KubeadmControlPlane", Namespace: k.Namespace, Name: k.Name, Spec: spec})
+		}
 	}
-	if err := json.Unmarshal(body, &MachineDeployment); err != nil {
-		fmt.Fprintln(os.Stderr, "Error unmarshaling response:", err)
-		os.Exit(1)
+
+	var mdList capiv1.MachineDeploymentList
+	if err := c.List(context.TODO(), &mdList, crclient.InNamespace(namespace)); err != nil {
+		fmt.Println("unable to list machinedeployments for backup:", err)
+	}
+	for _, m := range mdList.Items {
+		spec, err := json.Marshal(m.Spec)
+		if err != nil {
+			fmt.Println("unable to marshal machinedeployment", m.Name, "for backup:", err)
+			continue
+		}
+		snapshot = append(snapshot, backupObject{Kind: "MachineDeployment", Namespace: m.Namespace, Name: m.Name, Spec: spec})
 	}
 
-	getcurrenttime := time.Now().Format("Wed Feb 25 11:06:39 PST 2015")
+	return snapshot
+}
 
-	mdannotate := struct {
-		Date                            string `yaml:"date"`
-		RunTanzuVmwareComResolveOsImage string `yaml:"run.tanzu.vmware.com/resolve-os-image"`
-	}{
-		Date:                            getcurrenttime,
-		RunTanzuVmwareComResolveOsImage: "run.tanzu.vmware.com/resolve-os-image",
+// createBackup snapshots the objects an append/delete is about to mutate into a gzipped-JSON
+// Secret cclcmgr-backup-<id> so `rollback --id` can restore them if the mutation was a mistake
+func createBackup(c crclient.Client) string {
+	id := fmt.Sprintf("%d", time.Now().Unix())
+	if dryRun {
+		fmt.Println("[dry-run] would snapshot current objects into cclcmgr-backup-" + id)
+		return id
 	}
 
-	MachineDeployment.Spec.Template.Metadata.Annotations = struct {
-		Date                            string `json:"date"`
-		RunTanzuVmwareComResolveOsImage string `json:"run.tanzu.vmware.com/resolve-os-image"`
-	}(mdannotate)
+	raw, err := json.Marshal(snapshotObjects(c))
+	if err != nil {
+		fmt.Println("unable to marshal backup snapshot:", err)
+		return id
+	}
 
-	data, err := json.Marshal(MachineDeployment)
-	fmt.Println(string(data))
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(raw); err != nil {
+		fmt.Println("unable to gzip backup snapshot:", err)
+		return id
+	}
+	if err := gz.Close(); err != nil {
+		fmt.Println("unable to gzip backup snapshot:", err)
+		return id
+	}
 
-	request, err := http.NewRequest("PATCH", kubeapiserver+url, bytes.NewBuffer(data))
+	clientset, err := kubernetes.NewForConfig(kclient)
 	if err != nil {
 		fmt.Println(err)
+		return id
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cclcmgr-backup-" + id,
+			Namespace: backupNamespace,
+		},
+		Data: map[string][]byte{"backup": buf.Bytes()},
 	}
-	request.Header = map[string][]string{"Content-type": {"application/merge-patch+json"}}
-	resp, err := client.Do(request)
+	if _, err := clientset.CoreV1().Secrets(backupNamespace).Create(context.TODO(), secret, metav1.CreateOptions{}); err != nil {
+		fmt.Println("unable to persist backup secret:", err)
+		return id
+	}
+	fmt.Println("Backup snapshot saved as cclcmgr-backup-" + id)
+	return id
+}
+
+// rollbackToBackup reads the cclcmgr-backup-<id> Secret and patches every recorded object
+// back to its captured spec
+func rollbackToBackup(id string) {
+	if id == "" {
+		fmt.Println("rollback requires --id")
+		return
+	}
+	clientset, err := kubernetes.NewForConfig(kclient)
 	if err != nil {
 		fmt.Println(err)
+		return
 	}
-	fmt.Println("STATUS CODE: \n", resp.StatusCode)
-	defer resp.Body.Close()
-	bodyr, err := io.ReadAll(resp.Body)
+	secret, err := clientset.CoreV1().Secrets(backupNamespace).Get(context.TODO(), "cclcmgr-backup-"+id, metav1.GetOptions{})
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println("unable to get backup secret:", err)
+		return
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(secret.Data["backup"]))
+	if err != nil {
+		fmt.Println("unable to read gzipped backup:", err)
+		return
+	}
+	raw, err := io.ReadAll(gz)
+	if err != nil {
+		fmt.Println("unable to decompress backup:", err)
+		return
+	}
+
+	var snapshot []backupObject
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		fmt.Println("unable to parse backup:", err)
+		return
+	}
+
+	for _, entry := range snapshot {
+		switch entry.Kind {
+		case "KubeadmConfigTemplate":
+			var template bootstrapv1.KubeadmConfigTemplate
+			if err := k8sClient.Get(context.TODO(), crclient.ObjectKey{Namespace: entry.Namespace, Name: entry.Name}, &template); err != nil {
+				fmt.Println("unable to get kubeadmconfigtemplate", entry.Name, "for rollback:", err)
+				continue
+			}
+			original := template.DeepCopy()
+			if err := json.Unmarshal(entry.Spec, &template.Spec); err != nil {
+				fmt.Println("unable to parse recorded spec for", entry.Name, ":", err)
+				continue
+			}
+			if err := patchWithDiff(k8sClient, &template, original); err != nil {
+				fmt.Println("unable to roll back kubeadmconfigtemplate", entry.Name, ":", err)
+			}
+		case "KubeadmControlPlane":
+			var kcp kcpv1.KubeadmControlPlane
+			if err := k8sClient.Get(context.TODO(), crclient.ObjectKey{Namespace: entry.Namespace, Name: entry.Name}, &kcp); err != nil {
+				fmt.Println("unable to get kubeadmcontrolplane", entry.Name, "for rollback:", err)
+				continue
+			}
+			original := kcp.DeepCopy()
+			if err := json.Unmarshal(entry.Spec, &kcp.Spec); err != nil {
+				fmt.Println("unable to parse recorded spec for", entry.Name, ":", err)
+				continue
+			}
+			if err := patchWithDiff(k8sClient, &kcp, original); err != nil {
+				fmt.Println("unable to roll back kubeadmcontrolplane", entry.Name, ":", err)
+			}
+		case "MachineDeployment":
+			var md capiv1.MachineDeployment
+			if err := k8sClient.Get(context.TODO(), crclient.ObjectKey{Namespace: entry.Namespace, Name: entry.Name}, &md); err != nil {
+				fmt.Println("unable to get machinedeployment", entry.Name, "for rollback:", err)
+				continue
+			}
+			original := md.DeepCopy()
+			if err := json.Unmarshal(entry.Spec, &md.Spec); err != nil {
+				fmt.Println("unable to parse recorded spec for", entry.Name, ":", err)
+				continue
+			}
+			if err := patchWithDiff(k8sClient, &md, original); err != nil {
+				fmt.Println("unable to roll back machinedeployment", entry.Name, ":", err)
+			}
+		default:
+			fmt.Println("unknown kind in backup, skipping:", entry.Kind)
+		}
 	}
-	fmt.Println(string(bodyr))
+	fmt.Println("Rollback to cclcmgr-backup-" + id + " complete")
 }